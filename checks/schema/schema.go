@@ -23,8 +23,8 @@ type CheckResult struct {
 	Details   map[string]string
 }
 
-// Check : Information about a check to be run.
-type Check struct {
+// CheckContext : Information about a check to be run.
+type CheckContext struct {
 	ID             string
 	Name           string
 	Definition     map[string]string
@@ -5,28 +5,51 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/emersion/go-imap"
+	idle "github.com/emersion/go-imap-idle"
 	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-sasl"
 	"github.com/s-newman/scorestack/dynamicbeat/checks/schema"
 )
 
+// maxContentMatchMessages caps how many of the most recent search hits are
+// fetched and scanned when MatchContent is enabled, so a broad search
+// criteria can't force us to download an entire mailbox.
+const maxContentMatchMessages = 10
+
 // The Definition configures the behavior of the imap check
 // it implements the "check" interface
 type Definition struct {
-	Config    schema.CheckConfig // generic metadata about the check
-	Host      string             // (required) IP or hostname for the imap server
-	Username  string             // (required) Username for the imap server
-	Password  string             // (required) Password for the user of the imap server
-	Encrypted bool               // (optional, default=false) Whether or not to use TLS (IMAPS)
-	Port      string             // (optional, default=143) Port for the imap server
+	Config          schema.CheckConfig // generic metadata about the check
+	Host            string             // (required) IP or hostname for the imap server
+	Username        string             // (required) Username for the imap server
+	Password        string             // (required) Password for the user of the imap server
+	Encrypted       bool               // (optional, default=false) Whether or not to use TLS (IMAPS)
+	StartTLS        bool               // (optional, default=false) Dial plaintext then upgrade with STARTTLS before authenticating
+	Port            string             // (optional, default=143) Port for the imap server
+	AuthMechanism   string             // (optional, default="LOGIN") One of "LOGIN", "PLAIN", "XOAUTH2", "CRAM-MD5"
+	OAuthToken      string             // (required if AuthMechanism is "XOAUTH2") OAuth2 bearer token for the user
+	Mode            string             // (optional, default="list") One of "list", "idle", "fetch", "search"
+	Mailbox         string             // (optional, default="INBOX") Mailbox to SELECT for "idle" and content-matching modes
+	IdleDuration    string             // (optional, default="10s") How long to hold the IDLE command open, as a time.ParseDuration string
+	MatchContent    bool               // (optional, default=false) Turn this on to match content from messages in Mailbox
+	ContentRegex    string             // (optional, default=`.*`) Regexp for matching message bodies/headers
+	SearchCriteria  string             // (optional, default="UNSEEN") IMAP search criteria used to select messages to check
+	StatusMailboxes []string           // (optional) Mailboxes to probe for message/unseen/recent counts
+	MaxUnseen       uint32             // (optional, default=0, disabled) Fail the check if any StatusMailboxes mailbox exceeds this many unseen messages
+
+	worker *Worker // backing Worker for Mode == "idle" when run as a schema.StatefulCheck via Start/Stop
 }
 
 // Run a single instance of the check
 // We are only supporting the listing of mailboxes as a check currently
-func (d *Definition) Run(ctx context.Context, result schema.CheckResult) schema.CheckResult {
+func (d *Definition) Run(ctx context.Context) schema.CheckResult {
 
 	// Set up result
 	result := schema.CheckResult{
@@ -66,25 +89,361 @@ func (d *Definition) Run(ctx context.Context, result schema.CheckResult) schema.
 	// Set timeout for commands
 	c.Timeout = 5 * time.Second
 
-	// Login
-	err = c.Login(d.Username, d.Password)
+	// Upgrade to TLS before authenticating, if requested. This is distinct
+	// from Encrypted, which dials straight into IMAPS instead.
+	if d.StartTLS {
+		err = c.StartTLS(&tls.Config{})
+		if err != nil {
+			result.Message = fmt.Sprintf("STARTTLS with server %s failed : %s", d.Host, err)
+			return result
+		}
+	}
+
+	// Authenticate using the configured mechanism
+	err = d.authenticate(c)
 	if err != nil {
 		result.Message = fmt.Sprintf("Login with user %s failed : %s", d.Username, err)
 		return result
 	}
 
-	// List mailboxes
-	mailboxes := make(chan *imap.MailboxInfo, 10)
-	err = c.List("", "*", mailboxes)
+	switch d.Mode {
+	case "idle":
+		result = d.runIdle(ctx, c, result)
+	case "search", "fetch":
+		result = d.runContentMatch(c, result)
+	default:
+		if d.MatchContent {
+			result = d.runContentMatch(c, result)
+			break
+		}
+
+		// List mailboxes
+		mailboxes := make(chan *imap.MailboxInfo, 10)
+		err = c.List("", "*", mailboxes)
+		if err != nil {
+			result.Message = fmt.Sprintf("Listing mailboxes failed : %s", err)
+			return result
+		}
+
+		// If we make it here the check passes
+		result.Passed = true
+	}
+
+	if len(d.StatusMailboxes) > 0 {
+		result = d.populateMailboxStatus(c, result)
+	}
+
+	return result
+
+}
+
+// populateMailboxStatus queries imap.StatusMessages, imap.StatusUnseen,
+// imap.StatusRecent and imap.StatusUidNext for each mailbox in
+// d.StatusMailboxes and records them in result.Details as
+// "<mailbox>.messages", "<mailbox>.unseen", "<mailbox>.recent" and
+// "<mailbox>.uidnext", so
+// scorestack dashboards can graph mail-flow health rather than just up/down.
+// If d.MaxUnseen is set and any mailbox exceeds it, the check is failed.
+func (d *Definition) populateMailboxStatus(c *client.Client, result schema.CheckResult) schema.CheckResult {
+	if result.Details == nil {
+		result.Details = make(map[string]string)
+	}
+
+	for _, mailbox := range d.StatusMailboxes {
+		status, err := c.Status(mailbox, []imap.StatusItem{imap.StatusMessages, imap.StatusUnseen, imap.StatusRecent, imap.StatusUidNext})
+		if err != nil {
+			result.Message = fmt.Sprintf("Getting status of mailbox %s failed : %s", mailbox, err)
+			result.Passed = false
+			return result
+		}
+
+		result.Details[fmt.Sprintf("%s.messages", mailbox)] = fmt.Sprintf("%d", status.Messages)
+		result.Details[fmt.Sprintf("%s.unseen", mailbox)] = fmt.Sprintf("%d", status.Unseen)
+		result.Details[fmt.Sprintf("%s.recent", mailbox)] = fmt.Sprintf("%d", status.Recent)
+		result.Details[fmt.Sprintf("%s.uidnext", mailbox)] = fmt.Sprintf("%d", status.UidNext)
+
+		if d.MaxUnseen > 0 && status.Unseen > d.MaxUnseen {
+			result.Message = fmt.Sprintf("Mailbox %s has %d unseen messages, exceeding MaxUnseen of %d", mailbox, status.Unseen, d.MaxUnseen)
+			result.Passed = false
+			return result
+		}
+	}
+
+	return result
+}
+
+// authenticate logs in to the server using d.AuthMechanism. LOGIN (the
+// default) uses the plain IMAP LOGIN command; the rest build a
+// github.com/emersion/go-sasl client and authenticate via SASL, which is
+// required by hosted mail providers and Exchange deployments that disable
+// basic LOGIN.
+func (d *Definition) authenticate(c *client.Client) error {
+	switch strings.ToUpper(d.AuthMechanism) {
+	case "", "LOGIN":
+		return c.Login(d.Username, d.Password)
+	case "PLAIN":
+		return c.Authenticate(sasl.NewPlainClient("", d.Username, d.Password))
+	case "XOAUTH2":
+		return c.Authenticate(sasl.NewXoauth2Client(d.Username, d.OAuthToken))
+	case "CRAM-MD5":
+		return c.Authenticate(sasl.NewCramMD5Client(d.Username, d.Password))
+	default:
+		return fmt.Errorf("unsupported auth mechanism %q", d.AuthMechanism)
+	}
+}
+
+// runIdle exercises the RFC 2177 IDLE command against a logged-in client. It
+// SELECTs d.Mailbox, starts IDLE, waits for the server to accept it (or for
+// d.IdleDuration to elapse), then issues DONE and confirms the client is
+// still in the selected state with no protocol errors.
+func (d *Definition) runIdle(ctx context.Context, c *client.Client, result schema.CheckResult) schema.CheckResult {
+	_, err := c.Select(d.Mailbox, false)
+	if err != nil {
+		result.Message = fmt.Sprintf("Selecting mailbox %s failed : %s", d.Mailbox, err)
+		return result
+	}
+
+	idleClient := idle.NewClient(c)
+
+	idleDuration, err := time.ParseDuration(d.IdleDuration)
+	if err != nil {
+		result.Message = fmt.Sprintf("Parsing IdleDuration %q failed : %s", d.IdleDuration, err)
+		return result
+	}
+
+	idleCtx, cancel := context.WithTimeout(ctx, idleDuration)
+	defer cancel()
+
+	stop := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- idleClient.Idle(stop)
+	}()
+
+	select {
+	case <-idleCtx.Done():
+		close(stop)
+		err = <-done
+	case err = <-done:
+		// The server ended IDLE on its own before our timeout.
+	}
 	if err != nil {
-		result.Message = fmt.Sprintf("Listing mailboxes failed : %s", err)
+		result.Message = fmt.Sprintf("IDLE on mailbox %s failed : %s", d.Mailbox, err)
+		return result
+	}
+
+	if c.State() != imap.SelectedState {
+		result.Message = fmt.Sprintf("Client left selected state after IDLE on mailbox %s", d.Mailbox)
 		return result
 	}
 
-	// If we make it here the check passes
 	result.Passed = true
 	return result
+}
+
+// runContentMatch SELECTs d.Mailbox, runs a UID SEARCH using d.SearchCriteria,
+// then UID FETCHes the body and headers of the most recent hits and checks
+// them against d.ContentRegex. This verifies that a specific message actually
+// arrived in the mailbox, rather than just that IMAP is reachable.
+func (d *Definition) runContentMatch(c *client.Client, result schema.CheckResult) schema.CheckResult {
+	_, err := c.Select(d.Mailbox, false)
+	if err != nil {
+		result.Message = fmt.Sprintf("Selecting mailbox %s failed : %s", d.Mailbox, err)
+		return result
+	}
 
+	criteria, err := parseSearchCriteria(d.SearchCriteria)
+	if err != nil {
+		result.Message = fmt.Sprintf("Parsing search criteria %q failed : %s", d.SearchCriteria, err)
+		return result
+	}
+
+	uids, err := c.UidSearch(criteria)
+	if err != nil {
+		result.Message = fmt.Sprintf("Searching mailbox %s failed : %s", d.Mailbox, err)
+		return result
+	}
+	if len(uids) == 0 {
+		result.Message = fmt.Sprintf("No messages in mailbox %s matched search criteria %q", d.Mailbox, d.SearchCriteria)
+		return result
+	}
+
+	// Only fetch the most recent hits, since UIDs increase over time.
+	if len(uids) > maxContentMatchMessages {
+		uids = uids[len(uids)-maxContentMatchMessages:]
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	bodySection := &imap.BodySectionName{}
+	fetchItems := []imap.FetchItem{bodySection.FetchItem(), imap.FetchRFC822Header}
+
+	regex, err := regexp.Compile(d.ContentRegex)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
+		return result
+	}
+
+	messages := make(chan *imap.Message, len(uids))
+	done := make(chan error, 1)
+	go func() {
+		done <- c.UidFetch(seqset, fetchItems, messages)
+	}()
+
+	matched := false
+	for msg := range messages {
+		for _, literal := range msg.Body {
+			buf, readErr := ioutil.ReadAll(literal)
+			if readErr != nil {
+				continue
+			}
+			if regex.Match(buf) {
+				matched = true
+			}
+		}
+	}
+	if err = <-done; err != nil {
+		result.Message = fmt.Sprintf("Fetching messages from mailbox %s failed : %s", d.Mailbox, err)
+		return result
+	}
+
+	if !matched {
+		result.Message = fmt.Sprintf("Regex %q did not match any fetched messages in mailbox %s", d.ContentRegex, d.Mailbox)
+		return result
+	}
+
+	result.Passed = true
+	return result
+}
+
+// parseSearchCriteria translates a small space-separated subset of IMAP
+// SEARCH syntax (UNSEEN, SINCE <date>, SUBJECT "x", etc.) into an
+// *imap.SearchCriteria. An empty string searches for UNSEEN messages.
+func parseSearchCriteria(raw string) (*imap.SearchCriteria, error) {
+	if raw == "" {
+		raw = "UNSEEN"
+	}
+
+	criteria := &imap.SearchCriteria{
+		Header: make(map[string][]string),
+	}
+
+	tokens, err := tokenizeSearchCriteria(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(tokens); i++ {
+		switch strings.ToUpper(tokens[i]) {
+		case "ALL":
+			// no-op, matches everything
+		case "UNSEEN":
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.SeenFlag)
+		case "SEEN":
+			criteria.WithFlags = append(criteria.WithFlags, imap.SeenFlag)
+		case "ANSWERED":
+			criteria.WithFlags = append(criteria.WithFlags, imap.AnsweredFlag)
+		case "UNANSWERED":
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.AnsweredFlag)
+		case "FLAGGED":
+			criteria.WithFlags = append(criteria.WithFlags, imap.FlaggedFlag)
+		case "UNFLAGGED":
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.FlaggedFlag)
+		case "DELETED":
+			criteria.WithFlags = append(criteria.WithFlags, imap.DeletedFlag)
+		case "UNDELETED":
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.DeletedFlag)
+		case "DRAFT":
+			criteria.WithFlags = append(criteria.WithFlags, imap.DraftFlag)
+		case "UNDRAFT":
+			criteria.WithoutFlags = append(criteria.WithoutFlags, imap.DraftFlag)
+		case "SINCE":
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("SINCE requires a date argument")
+			}
+			criteria.Since, err = time.Parse("02-Jan-2006", tokens[i])
+			if err != nil {
+				return nil, fmt.Errorf("parsing SINCE date %q : %s", tokens[i], err)
+			}
+		case "BEFORE":
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("BEFORE requires a date argument")
+			}
+			criteria.Before, err = time.Parse("02-Jan-2006", tokens[i])
+			if err != nil {
+				return nil, fmt.Errorf("parsing BEFORE date %q : %s", tokens[i], err)
+			}
+		case "SUBJECT":
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("SUBJECT requires a value argument")
+			}
+			criteria.Header.Add("Subject", tokens[i])
+		case "FROM":
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("FROM requires a value argument")
+			}
+			criteria.Header.Add("From", tokens[i])
+		case "TO":
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("TO requires a value argument")
+			}
+			criteria.Header.Add("To", tokens[i])
+		case "BODY":
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("BODY requires a value argument")
+			}
+			criteria.Body = append(criteria.Body, tokens[i])
+		case "TEXT":
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("TEXT requires a value argument")
+			}
+			criteria.Text = append(criteria.Text, tokens[i])
+		default:
+			return nil, fmt.Errorf("unsupported search criteria keyword %q", tokens[i])
+		}
+	}
+
+	return criteria, nil
+}
+
+// tokenizeSearchCriteria splits raw search criteria on spaces, treating
+// double-quoted substrings as single tokens so values like SUBJECT "daily
+// report" stay together.
+func tokenizeSearchCriteria(raw string) ([]string, error) {
+	var tokens []string
+	var cur strings.Builder
+	inQuotes := false
+
+	flush := func() {
+		if cur.Len() > 0 {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+	}
+
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ' ' && !inQuotes:
+			flush()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	flush()
+
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quoted string in %q", raw)
+	}
+	return tokens, nil
 }
 
 // Init the check using a known ID and name. The rest of the check fields will
@@ -93,6 +452,11 @@ func (d *Definition) Init(config schema.CheckConfig, def []byte) error {
 
 	// Set optional values
 	d.Port = "143"
+	d.Mailbox = "INBOX"
+	d.IdleDuration = "10s"
+	d.ContentRegex = ".*"
+	d.SearchCriteria = "UNSEEN"
+	d.AuthMechanism = "LOGIN"
 
 	// Unpack JSON definition
 	err := json.Unmarshal(def, &d)
@@ -117,6 +481,10 @@ func (d *Definition) Init(config schema.CheckConfig, def []byte) error {
 		missingFields = append(missingFields, "Password")
 	}
 
+	if strings.ToUpper(d.AuthMechanism) == "XOAUTH2" && d.OAuthToken == "" {
+		missingFields = append(missingFields, "OAuthToken")
+	}
+
 	// Error only the first missing field, if there are any
 	if len(missingFields) > 0 {
 		return schema.ValidationError{
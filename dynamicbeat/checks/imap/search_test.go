@@ -0,0 +1,120 @@
+package imap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenizeSearchCriteria(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "single keyword",
+			raw:  "UNSEEN",
+			want: []string{"UNSEEN"},
+		},
+		{
+			name: "keyword and bare value",
+			raw:  "SINCE 01-Jan-2020",
+			want: []string{"SINCE", "01-Jan-2020"},
+		},
+		{
+			name: "quoted value with spaces stays one token",
+			raw:  `SUBJECT "daily report"`,
+			want: []string{"SUBJECT", "daily report"},
+		},
+		{
+			name: "collapses repeated whitespace",
+			raw:  "UNSEEN   FLAGGED",
+			want: []string{"UNSEEN", "FLAGGED"},
+		},
+		{
+			name: "empty string yields no tokens",
+			raw:  "",
+			want: nil,
+		},
+		{
+			name:    "unterminated quote is an error",
+			raw:     `SUBJECT "daily report`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenizeSearchCriteria(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("tokenizeSearchCriteria(%q) returned no error, want one", tt.raw)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("tokenizeSearchCriteria(%q) returned unexpected error : %s", tt.raw, err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("tokenizeSearchCriteria(%q) = %#v, want %#v", tt.raw, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("tokenizeSearchCriteria(%q) = %#v, want %#v", tt.raw, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseSearchCriteria(t *testing.T) {
+	t.Run("empty string defaults to UNSEEN", func(t *testing.T) {
+		criteria, err := parseSearchCriteria("")
+		if err != nil {
+			t.Fatalf("parseSearchCriteria(\"\") returned unexpected error : %s", err)
+		}
+		if len(criteria.WithoutFlags) != 1 || criteria.WithoutFlags[0] != "\\Seen" {
+			t.Fatalf("parseSearchCriteria(\"\") WithoutFlags = %#v, want [\\Seen]", criteria.WithoutFlags)
+		}
+	})
+
+	t.Run("SINCE parses a valid date", func(t *testing.T) {
+		criteria, err := parseSearchCriteria("SINCE 01-Jan-2020")
+		if err != nil {
+			t.Fatalf("parseSearchCriteria returned unexpected error : %s", err)
+		}
+		want := time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+		if !criteria.Since.Equal(want) {
+			t.Fatalf("criteria.Since = %s, want %s", criteria.Since, want)
+		}
+	})
+
+	t.Run("SINCE with a malformed date is an error", func(t *testing.T) {
+		if _, err := parseSearchCriteria("SINCE not-a-date"); err == nil {
+			t.Fatalf("parseSearchCriteria returned no error for a malformed SINCE date")
+		}
+	})
+
+	t.Run("SINCE with no argument is an error", func(t *testing.T) {
+		if _, err := parseSearchCriteria("SINCE"); err == nil {
+			t.Fatalf("parseSearchCriteria returned no error for a dangling SINCE")
+		}
+	})
+
+	t.Run("SUBJECT with a quoted value", func(t *testing.T) {
+		criteria, err := parseSearchCriteria(`SUBJECT "daily report"`)
+		if err != nil {
+			t.Fatalf("parseSearchCriteria returned unexpected error : %s", err)
+		}
+		if got := criteria.Header.Get("Subject"); got != "daily report" {
+			t.Fatalf("criteria.Header[Subject] = %q, want %q", got, "daily report")
+		}
+	})
+
+	t.Run("unsupported keyword is an error", func(t *testing.T) {
+		if _, err := parseSearchCriteria("BOGUS"); err == nil {
+			t.Fatalf("parseSearchCriteria returned no error for an unsupported keyword")
+		}
+	})
+}
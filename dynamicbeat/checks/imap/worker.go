@@ -0,0 +1,172 @@
+package imap
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	idle "github.com/emersion/go-imap-idle"
+	"github.com/emersion/go-imap/client"
+	"github.com/s-newman/scorestack/dynamicbeat/checks/schema"
+)
+
+// tickInterval is how often the worker emits a CheckResult while the
+// connection is healthy and no mailbox update has arrived.
+const tickInterval = 30 * time.Second
+
+// Worker implements schema.StatefulCheck for the imap check. It holds one
+// logged-in, IDLE-ing *client.Client for the lifetime of the check instead of
+// dialing, logging in and IDLE-ing from scratch every interval, so it can
+// emit a result as soon as the connection drops rather than waiting for the
+// next tick. This mirrors the aerc project's IMAPWorker design.
+type Worker struct {
+	def      *Definition
+	client   *client.Client
+	idle     *idle.Client
+	updates  chan client.Update
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewWorker dials and logs in to the imap server described by d, and
+// SELECTs d.Mailbox (default INBOX) so the returned Worker is ready to
+// Start.
+func NewWorker(d *Definition) (*Worker, error) {
+	dialer := net.Dialer{
+		Timeout: 20 * time.Second,
+	}
+
+	var c *client.Client
+	var err error
+	if d.Encrypted {
+		c, err = client.DialWithDialerTLS(&dialer, fmt.Sprintf("%s:%s", d.Host, d.Port), &tls.Config{})
+	} else {
+		c, err = client.DialWithDialer(&dialer, fmt.Sprintf("%s:%s", d.Host, d.Port))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connecting to server %s failed : %s", d.Host, err)
+	}
+
+	if d.StartTLS {
+		if err = c.StartTLS(&tls.Config{}); err != nil {
+			c.Logout()
+			return nil, fmt.Errorf("STARTTLS with server %s failed : %s", d.Host, err)
+		}
+	}
+
+	if err = d.authenticate(c); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("login with user %s failed : %s", d.Username, err)
+	}
+
+	if _, err = c.Select(d.Mailbox, false); err != nil {
+		c.Logout()
+		return nil, fmt.Errorf("selecting mailbox %s failed : %s", d.Mailbox, err)
+	}
+
+	updates := make(chan client.Update, 10)
+	c.Updates = updates
+
+	return &Worker{
+		def:     d,
+		client:  c,
+		idle:    idle.NewClient(c),
+		updates: updates,
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// Start begins IDLE-ing on the worker's connection and returns a channel
+// that receives a CheckResult on every tickInterval and immediately whenever
+// a MailboxUpdate/ExpungeUpdate arrives or the connection dies.
+func (w *Worker) Start(ctx context.Context) (<-chan schema.CheckResult, error) {
+	results := make(chan schema.CheckResult)
+
+	idleDone := make(chan error, 1)
+	go func() {
+		idleDone <- w.idle.IdleWithFallback(w.stop, 0)
+	}()
+
+	go func() {
+		defer close(results)
+		defer w.client.Logout()
+
+		ticker := time.NewTicker(tickInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				w.stopOnce.Do(func() { close(w.stop) })
+				return
+			case <-w.stop:
+				return
+			case err := <-idleDone:
+				results <- w.result(err)
+				return
+			case update, ok := <-w.updates:
+				if !ok {
+					results <- w.result(fmt.Errorf("update channel closed unexpectedly"))
+					return
+				}
+				switch update.(type) {
+				case *client.MailboxUpdate, *client.ExpungeUpdate:
+					results <- w.result(nil)
+				}
+			case <-ticker.C:
+				results <- w.result(nil)
+			}
+		}
+	}()
+
+	return results, nil
+}
+
+// Stop tears down the worker's IDLE command and connection. It is safe to
+// call more than once, and safe to race with ctx being canceled.
+func (w *Worker) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+// Start implements schema.StatefulCheck. It is the entry point a dispatcher
+// should use instead of Run when d.Mode == "idle": it builds a Worker bound
+// to d, remembers it so a later Stop call can tear it down, and returns its
+// result channel.
+func (d *Definition) Start(ctx context.Context) (<-chan schema.CheckResult, error) {
+	w, err := NewWorker(d)
+	if err != nil {
+		return nil, err
+	}
+	d.worker = w
+	return w.Start(ctx)
+}
+
+// Stop tears down the Worker started by Start. It is a no-op if Start was
+// never called.
+func (d *Definition) Stop() {
+	if d.worker != nil {
+		d.worker.Stop()
+	}
+}
+
+// result builds a passing CheckResult, or a failing one if err is non-nil
+// (e.g. the IDLE command errored or the socket died).
+func (w *Worker) result(err error) schema.CheckResult {
+	result := schema.CheckResult{
+		Timestamp:   time.Now(),
+		ID:          w.def.Config.ID,
+		Name:        w.def.Config.Name,
+		Group:       w.def.Config.Group,
+		ScoreWeight: w.def.Config.ScoreWeight,
+		CheckType:   "imap",
+	}
+	if err != nil {
+		result.Message = fmt.Sprintf("IMAP IDLE connection to %s failed : %s", w.def.Host, err)
+		return result
+	}
+	result.Passed = true
+	return result
+}
@@ -0,0 +1,53 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// CheckConfig : Generic metadata shared by every check, regardless of type.
+type CheckConfig struct {
+	ID          string
+	Name        string
+	Group       string
+	ScoreWeight float64
+}
+
+// CheckResult : Information about the results of executing a check.
+type CheckResult struct {
+	Timestamp   time.Time
+	ID          string
+	Name        string
+	Group       string
+	ScoreWeight float64
+	CheckType   string
+	Passed      bool
+	Message     string
+	Details     map[string]string
+}
+
+// StatefulCheck is implemented by checks that hold one persistent connection
+// across the life of the check instead of reconnecting every interval, so
+// they can observe push-style protocols (e.g. IMAP IDLE) rather than forcing
+// a full handshake each tick. Start spins up the worker goroutine and returns
+// a channel that receives a CheckResult on every tick and immediately
+// whenever the connection's state changes; Stop tears the worker down. The
+// dispatcher should accept either a one-shot check (Run(ctx) CheckResult) or
+// a StatefulCheck, so existing checks keep working unmodified.
+type StatefulCheck interface {
+	Start(ctx context.Context) (<-chan CheckResult, error)
+	Stop()
+}
+
+// ValidationError is returned by a check's Init when a required field is
+// missing from its definition.
+type ValidationError struct {
+	ID    string
+	Type  string
+	Field string
+}
+
+func (e ValidationError) Error() string {
+	return fmt.Sprintf("check %s (type %s) is missing required field %s", e.ID, e.Type, e.Field)
+}
@@ -6,11 +6,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	krb5client "github.com/jcmturner/gokrb5/v8/client"
+	"github.com/jcmturner/gokrb5/v8/config"
+	"github.com/jcmturner/gokrb5/v8/spnego"
 	"github.com/masterzen/winrm"
+	"github.com/masterzen/winrm/soap"
 	"github.com/s-newman/scorestack/dynamicbeat/checks/schema"
 )
 
@@ -26,10 +33,12 @@ type Definition struct {
 	MatchContent bool               // (optional, default=false) Turn this on to match content from the output of the cmd
 	ContentRegex string             // (optional, default=`.*`) Regexp for matching output of a command
 	Port         string             // (optional, default=5986) Port for WinRM
+	AuthType     string             // (optional, default="basic") One of "basic", "ntlm", "kerberos"
+	Domain       string             // (required if AuthType is "ntlm" or "kerberos") AD domain to authenticate against
 }
 
 // Run a single instance of the check
-func (d *Definition) Run(ctx context.Context, result schema.CheckResult) schema.CheckResult {
+func (d *Definition) Run(ctx context.Context) schema.CheckResult {
 
 	// Set up result
 	result := schema.CheckResult{
@@ -48,27 +57,46 @@ func (d *Definition) Run(ctx context.Context, result schema.CheckResult) schema.
 		return result
 	}
 
-	// CHECK REAPER 3000
-	// done := make(chan bool)
-	// go func() {
-	// Another timeout for the bois
 	params := *winrm.DefaultParameters
 	params.Timeout = "22"
 
+	// username is the identity WinRM authenticates as. NTLM needs it
+	// qualified with the AD domain; basic and Kerberos auth use it as-is
+	// (Kerberos authenticates d.Username@d.Domain via the ticket instead).
+	username := d.Username
+
+	// Pick a transport for the configured auth type. Basic auth over the
+	// default transport fails against domain-joined Windows hosts, which
+	// typically require NTLM or Kerberos instead.
+	switch strings.ToLower(d.AuthType) {
+	case "", "basic":
+		// default transport already does HTTP basic auth
+	case "ntlm":
+		params.TransportDecorator = func() winrm.Transporter { return &winrm.ClientNTLM{} }
+		username = fmt.Sprintf(`%s\%s`, d.Domain, d.Username)
+	case "kerberos":
+		transport, krbErr := newKerberosTransport(d)
+		if krbErr != nil {
+			result.Message = fmt.Sprintf("Setting up Kerberos transport for host %s failed : %s", d.Host, krbErr)
+			return result
+		}
+		params.TransportDecorator = func() winrm.Transporter { return transport }
+	default:
+		result.Message = fmt.Sprintf("Unsupported AuthType %q", d.AuthType)
+		return result
+	}
+
 	// Login to winrm and create client
-	// endpoint := winrm.NewEndpoint(d.Host, port, d.Encrypted, true, nil, nil, nil, 5*time.Second)
 	endpoint := winrm.NewEndpoint(d.Host, port, d.Encrypted, true, nil, nil, nil, 20*time.Second)
-	client, err := winrm.NewClientWithParameters(endpoint, d.Username, d.Password, &params)
+	client, err := winrm.NewClientWithParameters(endpoint, username, d.Password, &params)
 	if err != nil {
 		result.Message = fmt.Sprintf("Login to WinRM host %s failed : %s", d.Host, err)
-		// done <- true
 		return result
 	}
 
 	shell, err := client.CreateShell()
 	if err != nil {
 		result.Message = fmt.Sprintf("Failed to create shell : %s", err)
-		// done <- true
 		return result
 	}
 	defer func() {
@@ -79,105 +107,119 @@ func (d *Definition) Run(ctx context.Context, result schema.CheckResult) schema.
 
 	powershellCmd := winrm.Powershell(d.Cmd)
 
-	cmd, err := shell.Execute(powershellCmd)
+	cmd, err := shell.ExecuteWithContext(ctx, powershellCmd)
 	if err != nil {
 		result.Message = fmt.Sprintf("Executing command %s failed : %s", d.Cmd, err)
-		// done <- true
 		return result
 	}
 
-	var test sync.WaitGroup
+	var wg sync.WaitGroup
 	copyFunc := func(w io.Writer, r io.Reader) {
-		defer test.Done()
+		defer wg.Done()
 		io.Copy(w, r)
-		return
 	}
 
 	bufOut := new(bytes.Buffer)
 
 	if cmd.Stdout != nil {
-		test.Add(1)
+		wg.Add(1)
 		go copyFunc(bufOut, cmd.Stdout)
 	} else {
-		result.Message = fmt.Sprintf("Failed to get stdout from command %s : %s", d.Cmd, err)
-		// done <- true
+		result.Message = fmt.Sprintf("Failed to get stdout from command %s", d.Cmd)
 		return result
 	}
 
 	cmd.Wait()
-	test.Wait()
-
-	// command := winrm.Powershell(d.Cmd)
-
-	// // shell := client.NewShell("ScoreStack-Shell-ID")
-	// // defer shell.Close()
-
-	// // cmdOut, err := shell.Execute(command)
-	// // defer cmdOut.Close()
-
-	// // if err != nil {
-	// // 	result.Message = fmt.Sprintf("Command %s failed : %s", d.Cmd, err)
-	// // 	failed <- true
-	// // 	return
-	// // }
-
-	// // Define these for the command output
-	// bufOut := new(bytes.Buffer)
-	// bufErr := new(bytes.Buffer)
-
-	// _, err = client.Run(command, bufOut, bufErr)
-	// if err != nil {
-	// 	result.Message = fmt.Sprintf("Running command %s failed : %s", d.Cmd, err)
-	// 	failed <- true
-	// 	return
-	// }
-
-	// // Check if the command errored
-	// if bufErr.String() != "" {
-	// 	result.Message = fmt.Sprintf("Executing command %s failed : %s", d.Cmd, bufErr.String())
-	// 	failed <- true
-	// 	return
-	// }
-
-	// // Check if we matching content and the command did not error
-	// if !d.MatchContent {
-	// 	// If we make it here, no content matching, the check succeeds
-	// 	result.Message = fmt.Sprintf("Command %s executed seccessfully: %s", d.Cmd, bufOut.String())
-	// 	done <- true
-	// 	return
-	// }
-
-	// // Keep going if we are matching content
-	// // Create regexp
-	// regex, err := regexp.Compile(d.ContentRegex)
-	// if err != nil {
-	// 	result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
-	// 	failed <- true
-	// 	return
-	// }
-
-	// // Check if the content matches
-	// if !regex.Match(bufOut.Bytes()) {
-	// 	result.Message = fmt.Sprintf("Matching content not found")
-	// 	failed <- true
-	// 	return
-	// }
-
-	// If we reach here the check is successful
+	wg.Wait()
+
+	// Check if we're matching content and the command did not error
+	if !d.MatchContent {
+		result.Passed = true
+		return result
+	}
+
+	regex, err := regexp.Compile(d.ContentRegex)
+	if err != nil {
+		result.Message = fmt.Sprintf("Error compiling regex string %s : %s", d.ContentRegex, err)
+		return result
+	}
+
+	if !regex.Match(bufOut.Bytes()) {
+		result.Message = "Matching content not found"
+		return result
+	}
+
 	result.Passed = true
-	// done <- true
 	return result
-	// }()
-
-	// for {
-	// 	select {
-	// 	case <-ctx.Done():
-	// 		result.Message = fmt.Sprintf("Timeout limit reached: %s", ctx.Err())
-	// 		return result
-	// 	case <-done:
-	// 		return result
-	// 	}
-	// }
+}
+
+// newKerberosTransport builds a winrm.Transporter that authenticates over
+// HTTP Negotiate/SPNEGO using a Kerberos ticket for d.Username@d.Domain, for
+// domain-joined Windows hosts that disable NTLM.
+func newKerberosTransport(d *Definition) (winrm.Transporter, error) {
+	if d.Domain == "" {
+		return nil, fmt.Errorf("Domain is required for AuthType \"kerberos\"")
+	}
+
+	krbConf, err := config.Load("/etc/krb5.conf")
+	if err != nil {
+		return nil, fmt.Errorf("loading krb5.conf : %s", err)
+	}
+
+	krbClient := krb5client.NewWithPassword(d.Username, strings.ToUpper(d.Domain), d.Password, krbConf, krb5client.DisablePAFXFAST(true))
+	if err := krbClient.Login(); err != nil {
+		return nil, fmt.Errorf("Kerberos login for user %s failed : %s", d.Username, err)
+	}
+
+	return &kerberosTransport{krbClient: krbClient}, nil
+}
+
+// kerberosTransport implements winrm.Transporter by POSTing SOAP requests
+// through its own SPNEGO-aware http.Client. The endpoint's TLS settings
+// (Insecure, CACert, client certificate) are not applied to that client.
+type kerberosTransport struct {
+	krbClient *krb5client.Client
+	endpoint  *winrm.Endpoint
+	http      *http.Client
+}
+
+func (k *kerberosTransport) Transport(endpoint *winrm.Endpoint) error {
+	k.endpoint = endpoint
+	k.http = &http.Client{
+		Transport: spnego.NewTransport(k.krbClient, fmt.Sprintf("HTTP/%s", endpoint.Host)),
+		Timeout:   endpoint.Timeout,
+	}
+	return nil
+}
+
+func (k *kerberosTransport) Post(client *winrm.Client, request *soap.SoapMessage) (string, error) {
+	scheme := "http"
+	if k.endpoint.HTTPS {
+		scheme = "https"
+	}
+	url := fmt.Sprintf("%s://%s:%d/wsman", scheme, k.endpoint.Host, k.endpoint.Port)
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(request.String()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/soap+xml;charset=UTF-8")
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body := new(bytes.Buffer)
+	if _, err := body.ReadFrom(resp.Body); err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("WinRM request failed with status %s: %s", resp.Status, body.String())
+	}
+	return body.String(), nil
 }
 
 // Init the check using a known ID and name. The rest of the check fields will
@@ -188,6 +230,7 @@ func (d *Definition) Init(config schema.CheckConfig, def []byte) error {
 	d.Encrypted = true
 	d.ContentRegex = ".*"
 	d.Port = "5986"
+	d.AuthType = "basic"
 
 	// Unpack JSON definition
 	err := json.Unmarshal(def, &d)
@@ -216,6 +259,10 @@ func (d *Definition) Init(config schema.CheckConfig, def []byte) error {
 		missingFields = append(missingFields, "Cmd")
 	}
 
+	if (strings.ToLower(d.AuthType) == "ntlm" || strings.ToLower(d.AuthType) == "kerberos") && d.Domain == "" {
+		missingFields = append(missingFields, "Domain")
+	}
+
 	// Error only the first missing field, if there are any
 	if len(missingFields) > 0 {
 		return schema.ValidationError{